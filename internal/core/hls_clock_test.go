@@ -0,0 +1,57 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHLSClockFirstSampleIsOffsetOnly(t *testing.T) {
+	c := newHLSClock()
+
+	pts, pace, rtc := c.process(hlsClockTrackVideo, 90000) // 1s at 90kHz
+	require.Equal(t, time.Duration(0), pace)
+	require.Equal(t, hlsClockPTSOffset, pts)
+	require.False(t, rtc.IsZero())
+}
+
+func TestHLSClockTracksStaySyncedAcrossTracks(t *testing.T) {
+	c := newHLSClock()
+
+	videoPTS, _, videoRTC := c.process(hlsClockTrackVideo, 90000)
+	audioPTS, _, audioRTC := c.process(hlsClockTrackAudio, 90000+45000) // 0.5s later
+
+	require.Equal(t, videoRTC, audioRTC)
+	require.Equal(t, 500*time.Millisecond, audioPTS-videoPTS)
+}
+
+func TestHLSClockUnwrapsWraparound(t *testing.T) {
+	c := newHLSClock()
+
+	_, pace1, _ := c.process(hlsClockTrackVideo, hlsClockPTSMax-90000) // 1s before wraparound
+	_, pace2, _ := c.process(hlsClockTrackVideo, 90000)                // wraps around, 2s after pace1
+
+	require.Equal(t, 2*time.Second, pace2-pace1)
+}
+
+// TestHLSClockDoesNotConflateTracksOnPIDCollision guards against the video
+// rendition and a separate AUDIO alternative rendition numerically reusing
+// the same TS PID across their independent PMT namespaces: the clock must
+// key on the logical track, not the raw PID, or their timelines would
+// corrupt each other.
+func TestHLSClockDoesNotConflateTracksOnPIDCollision(t *testing.T) {
+	c := newHLSClock()
+
+	// both "PID 256" in their own rendition, far apart in raw PTS
+	videoPTS, _, _ := c.process(hlsClockTrackVideo, 90000)
+	audioPTS, _, _ := c.process(hlsClockTrackAudio, hlsClockPTSMax-90000)
+
+	require.Equal(t, hlsClockPTSOffset, videoPTS)
+	require.NotEqual(t, videoPTS, audioPTS)
+
+	// the next video sample must be unwrapped against the last video PTS,
+	// not the audio one, so it lands exactly 1s after the first
+	videoPTS2, _, _ := c.process(hlsClockTrackVideo, 180000)
+	require.Equal(t, hlsClockPTSOffset+time.Second, videoPTS2)
+}
@@ -0,0 +1,209 @@
+package core
+
+import (
+	"context"
+	_ "embed" // for go:embed
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aler9/gortsplib"
+
+	"github.com/aler9/rtsp-simple-server/internal/logger"
+)
+
+const (
+	hlsManagerCloseAfterInactivity = 60 * time.Second
+)
+
+//go:embed hls_index.html
+var hlsIndex []byte
+
+// hlsManagerPathMan is implemented by pathManager and lets hlsManager check
+// whether a path exists and is authorized to be read before spawning a
+// muxer for it.
+type hlsManagerPathMan interface {
+	OnReaderSetupPlay(req pathReaderSetupPlayReq) pathReaderSetupPlayRes
+}
+
+type hlsManagerParent interface {
+	Log(logger.Level, string, ...interface{})
+}
+
+// hlsManager routes incoming HTTP requests to the muxer of the requested
+// path, creating and tearing down muxers on demand.
+type hlsManager struct {
+	segmentCount    int
+	segmentDuration time.Duration
+	allowOrigin     string
+	alwaysRemux     bool
+	pathMan         hlsManagerPathMan
+	parent          hlsManagerParent
+
+	ctx        context.Context
+	ctxCancel  func()
+	wg         sync.WaitGroup
+	httpServer *http.Server
+
+	mutex  sync.Mutex
+	muxers map[string]*hlsMuxer
+}
+
+func newHLSManager(
+	parentCtx context.Context,
+	address string,
+	alwaysRemux bool,
+	segmentCount int,
+	segmentDuration time.Duration,
+	allowOrigin string,
+	pathMan hlsManagerPathMan,
+	parent hlsManagerParent) (*hlsManager, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, ctxCancel := context.WithCancel(parentCtx)
+
+	m := &hlsManager{
+		segmentCount:    segmentCount,
+		segmentDuration: segmentDuration,
+		allowOrigin:     allowOrigin,
+		alwaysRemux:     alwaysRemux,
+		pathMan:         pathMan,
+		parent:          parent,
+		ctx:             ctx,
+		ctxCancel:       ctxCancel,
+		muxers:          make(map[string]*hlsMuxer),
+	}
+
+	m.httpServer = &http.Server{
+		Handler: m,
+	}
+
+	m.log(logger.Info, "listener opened on %s", address)
+
+	m.wg.Add(1)
+	go m.run(ln)
+
+	return m, nil
+}
+
+func (m *hlsManager) log(level logger.Level, format string, args ...interface{}) {
+	m.parent.Log(level, "[hls manager] "+format, args...)
+}
+
+func (m *hlsManager) close() {
+	m.ctxCancel()
+	m.wg.Wait()
+}
+
+func (m *hlsManager) run(ln net.Listener) {
+	defer m.wg.Done()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- m.httpServer.Serve(ln)
+	}()
+
+	select {
+	case <-serveErr:
+	case <-m.ctx.Done():
+		m.httpServer.Shutdown(context.Background())
+		<-serveErr
+	}
+
+	m.mutex.Lock()
+	for _, mux := range m.muxers {
+		mux.close()
+	}
+	m.mutex.Unlock()
+
+	m.log(logger.Info, "listener closed")
+}
+
+// ServeHTTP implements http.Handler. Requests are of the form
+// /{path}/index.m3u8, /{path}/stream.m3u8 or /{path}/segmentN.ts; a bare
+// /{path}/ serves an embedded index.html that loads hls.js.
+func (m *hlsManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.allowOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", m.allowOrigin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	pathName, fileName := hlsManagerSplitPath(r.URL.Path)
+	if pathName == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	res := m.pathMan.OnReaderSetupPlay(pathReaderSetupPlayReq{
+		PathName: pathName,
+		IP:       hlsManagerRequestIP(r),
+	})
+	if res.Err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	mux := m.muxerForPath(pathName, res.Stream, res.Tracks)
+
+	if fileName == "" {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(hlsIndex)
+		return
+	}
+
+	mux.handleRequest(w, fileName)
+}
+
+func (m *hlsManager) muxerForPath(pathName string, stream *stream, tracks gortsplib.Tracks) *hlsMuxer {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if mux, ok := m.muxers[pathName]; ok {
+		return mux
+	}
+
+	mux := newHLSMuxer(pathName, m.segmentCount, m.segmentDuration, hlsManagerCloseAfterInactivity,
+		m.alwaysRemux, stream, tracks, m)
+	m.muxers[pathName] = mux
+	return mux
+}
+
+// OnMuxerClose implements hlsMuxerParent.
+func (m *hlsManager) OnMuxerClose(mux *hlsMuxer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.muxers[mux.pathName] == mux {
+		delete(m.muxers, mux.pathName)
+	}
+}
+
+// Log implements hlsMuxerParent.
+func (m *hlsManager) Log(level logger.Level, format string, args ...interface{}) {
+	m.log(level, format, args...)
+}
+
+func hlsManagerSplitPath(urlPath string) (pathName string, fileName string) {
+	urlPath = strings.TrimPrefix(urlPath, "/")
+
+	i := strings.Index(urlPath, "/")
+	if i < 0 {
+		return urlPath, ""
+	}
+
+	return urlPath[:i], urlPath[i+1:]
+}
+
+func hlsManagerRequestIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
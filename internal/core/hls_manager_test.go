@@ -0,0 +1,28 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHLSManagerSplitPath(t *testing.T) {
+	for _, ca := range []struct {
+		name             string
+		urlPath          string
+		expectedPathName string
+		expectedFileName string
+	}{
+		{"index", "/mypath/", "mypath", ""},
+		{"playlist", "/mypath/stream.m3u8", "mypath", "stream.m3u8"},
+		{"segment", "/mypath/segment3.ts", "mypath", "segment3.ts"},
+		{"nested path", "/cams/cam1/stream.m3u8", "cams", "cam1/stream.m3u8"},
+		{"no trailing slash", "/mypath", "mypath", ""},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			pathName, fileName := hlsManagerSplitPath(ca.urlPath)
+			require.Equal(t, ca.expectedPathName, pathName)
+			require.Equal(t, ca.expectedFileName, fileName)
+		})
+	}
+}
@@ -0,0 +1,463 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/rtpaac"
+	"github.com/aler9/gortsplib/pkg/rtph264"
+	"github.com/asticode/go-astits"
+	"github.com/pion/rtp"
+
+	"github.com/aler9/rtsp-simple-server/internal/aac"
+	"github.com/aler9/rtsp-simple-server/internal/h264"
+	"github.com/aler9/rtsp-simple-server/internal/logger"
+)
+
+const (
+	// hlsMuxerVideoPID and hlsMuxerAudioPID are the elementary-stream PIDs
+	// used for every segment this muxer writes.
+	hlsMuxerVideoPID = 256
+	hlsMuxerAudioPID = 257
+)
+
+// hlsMuxerSegment is one MPEG-TS segment kept in the muxer's ring.
+type hlsMuxerSegment struct {
+	name     string
+	duration time.Duration
+	buf      *bytes.Buffer
+}
+
+// hlsMuxerCurSegment is the segment currently being written to.
+type hlsMuxerCurSegment struct {
+	buf       *bytes.Buffer
+	tsMuxer   *astits.Muxer
+	startTime time.Time
+}
+
+func ptsToClockRef(pts time.Duration) *astits.ClockReference {
+	return &astits.ClockReference{Base: int64(pts.Seconds() * 90000)}
+}
+
+type hlsMuxerParent interface {
+	Log(logger.Level, string, ...interface{})
+	OnMuxerClose(*hlsMuxer)
+}
+
+// hlsMuxer converts a path's RTP stream into MPEG-TS segments and exposes
+// them as an HLS media playlist. One is created per path, on demand, on the
+// first HTTP request that targets it.
+type hlsMuxer struct {
+	pathName             string
+	segmentCount         int
+	segmentDuration      time.Duration
+	closeAfterInactivity time.Duration
+	alwaysRemux          bool
+	stream               *stream
+	tracks               gortsplib.Tracks
+	parent               hlsMuxerParent
+
+	mutex             sync.Mutex
+	videoTrackID      int
+	audioTrackID      int
+	videoDecoder      *rtph264.Decoder
+	videoSPS          []byte
+	videoPPS          []byte
+	audioDecoder      *rtpaac.Decoder
+	audioConfig       *gortsplib.MPEG4AudioConfig
+	curSegment        *hlsMuxerCurSegment
+	segments          []*hlsMuxerSegment
+	nextSegmentID     int
+	lastRequestTime   time.Time
+	readerUnsubscribe func()
+
+	terminate chan struct{}
+	done      chan struct{}
+}
+
+func newHLSMuxer(
+	pathName string,
+	segmentCount int,
+	segmentDuration time.Duration,
+	closeAfterInactivity time.Duration,
+	alwaysRemux bool,
+	stream *stream,
+	tracks gortsplib.Tracks,
+	parent hlsMuxerParent) *hlsMuxer {
+	m := &hlsMuxer{
+		pathName:             pathName,
+		segmentCount:         segmentCount,
+		segmentDuration:      segmentDuration,
+		closeAfterInactivity: closeAfterInactivity,
+		alwaysRemux:          alwaysRemux,
+		stream:               stream,
+		tracks:               tracks,
+		parent:               parent,
+		videoTrackID:         -1,
+		audioTrackID:         -1,
+		lastRequestTime:      time.Now(),
+		terminate:            make(chan struct{}),
+		done:                 make(chan struct{}),
+	}
+
+	go m.run()
+
+	return m
+}
+
+func (m *hlsMuxer) close() {
+	close(m.terminate)
+	<-m.done
+}
+
+func (m *hlsMuxer) log(level logger.Level, format string, args ...interface{}) {
+	m.parent.Log(level, "[hls muxer %s] "+format, append([]interface{}{m.pathName}, args...)...)
+}
+
+func (m *hlsMuxer) run() {
+	defer close(m.done)
+	defer m.parent.OnMuxerClose(m)
+
+	m.log(logger.Info, "opened")
+	defer m.log(logger.Info, "closed")
+
+	for _, track := range m.tracks {
+		switch {
+		case track.IsH264():
+			m.videoTrackID = track.ID
+			m.videoDecoder = rtph264.NewDecoder()
+
+			sps, pps, err := track.ExtractConfigH264()
+			if err == nil {
+				m.videoSPS = sps
+				m.videoPPS = pps
+			}
+
+		case track.IsAAC():
+			m.audioTrackID = track.ID
+			cnf, err := track.ExtractConfigAAC()
+			if err == nil {
+				m.audioConfig = cnf
+				m.audioDecoder = rtpaac.NewDecoder(cnf.SampleRate)
+			}
+		}
+	}
+
+	m.readerUnsubscribe = m.stream.readerAdd(m.onFrame)
+	defer m.readerUnsubscribe()
+
+	defer func() {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		if m.curSegment != nil {
+			m.onSegmentFinishedLocked(m.curSegment.buf, time.Since(m.curSegment.startTime))
+		}
+	}()
+
+	checkTicker := time.NewTicker(m.closeAfterInactivity / 2)
+	defer checkTicker.Stop()
+
+	for {
+		select {
+		case <-checkTicker.C:
+			// alwaysRemux keeps the muxer (and the underlying path) alive
+			// even without clients, so it's never closed for inactivity
+			if m.alwaysRemux {
+				continue
+			}
+
+			m.mutex.Lock()
+			inactive := time.Since(m.lastRequestTime) >= m.closeAfterInactivity
+			m.mutex.Unlock()
+
+			if inactive {
+				return
+			}
+
+		case <-m.terminate:
+			return
+		}
+	}
+}
+
+// onFrame is called by the path's stream for every RTP frame read from any
+// reader track; it demuxes H264/AAC and feeds the result into the TS muxer.
+func (m *hlsMuxer) onFrame(trackID int, streamType gortsplib.StreamType, payload []byte) {
+	if streamType != gortsplib.StreamTypeRTP {
+		return
+	}
+
+	switch trackID {
+	case m.videoTrackID:
+		m.onVideoFrame(payload)
+	case m.audioTrackID:
+		m.onAudioFrame(payload)
+	}
+}
+
+func (m *hlsMuxer) onVideoFrame(payload []byte) {
+	if m.videoDecoder == nil {
+		return
+	}
+
+	pkt := &rtp.Packet{}
+	if err := pkt.Unmarshal(payload); err != nil {
+		return
+	}
+
+	nalus, pts, err := m.videoDecoder.Decode(pkt)
+	if err != nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var outNALUs [][]byte
+	isKeyframe := false
+
+	for _, nalu := range nalus {
+		typ := h264.NALUType(nalu[0] & 0x1F)
+
+		switch typ {
+		case h264.NALUTypeSPS:
+			m.videoSPS = nalu
+			continue
+		case h264.NALUTypePPS:
+			m.videoPPS = nalu
+			continue
+		case h264.NALUTypeAccessUnitDelimiter:
+			continue
+		case h264.NALUTypeIDR:
+			isKeyframe = true
+		}
+
+		outNALUs = append(outNALUs, nalu)
+	}
+
+	if len(outNALUs) == 0 {
+		return
+	}
+
+	// the TS/Annex-B output has no out-of-band channel for parameter sets
+	// like the RTP track's SDP has, so SPS/PPS must be real NALUs, sent
+	// again at the start of every segment
+	if isKeyframe && m.videoSPS != nil && m.videoPPS != nil {
+		outNALUs = append([][]byte{m.videoSPS, m.videoPPS}, outNALUs...)
+	}
+
+	if m.curSegment == nil {
+		// start cleanly: a segment must begin with an IDR, otherwise a
+		// client tuning in can't decode anything until the next one
+		if !isKeyframe {
+			return
+		}
+		m.rotateSegmentLocked()
+	} else if isKeyframe && time.Since(m.curSegment.startTime) >= m.segmentDuration {
+		m.rotateSegmentLocked()
+	}
+
+	err = m.writeVideoLocked(outNALUs, pts)
+	if err != nil {
+		m.log(logger.Debug, "ERR while muxing video: %v", err)
+	}
+}
+
+func (m *hlsMuxer) onAudioFrame(payload []byte) {
+	if m.audioDecoder == nil {
+		return
+	}
+
+	pkt := &rtp.Packet{}
+	if err := pkt.Unmarshal(payload); err != nil {
+		return
+	}
+
+	aus, pts, err := m.audioDecoder.Decode(pkt)
+	if err != nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.curSegment == nil {
+		// when there's a video track, wait for its first keyframe to open
+		// the first segment, so segments always start on an IDR
+		if m.videoTrackID >= 0 {
+			return
+		}
+		m.rotateSegmentLocked()
+	} else if m.videoTrackID < 0 && time.Since(m.curSegment.startTime) >= m.segmentDuration {
+		// without a video track, segments are rotated by duration alone
+		m.rotateSegmentLocked()
+	}
+
+	err = m.writeAudioLocked(aus, pts)
+	if err != nil {
+		m.log(logger.Debug, "ERR while muxing audio: %v", err)
+	}
+}
+
+// rotateSegmentLocked finishes the current TS segment, if any, and opens a
+// new one with fresh PAT/PMT tables.
+func (m *hlsMuxer) rotateSegmentLocked() {
+	if m.curSegment != nil {
+		m.onSegmentFinishedLocked(m.curSegment.buf, time.Since(m.curSegment.startTime))
+	}
+
+	buf := &bytes.Buffer{}
+	tsMuxer := astits.NewMuxer(context.Background(), buf)
+
+	if m.videoTrackID >= 0 {
+		tsMuxer.AddElementaryStream(astits.PMTElementaryStream{
+			ElementaryPID: hlsMuxerVideoPID,
+			StreamType:    astits.StreamTypeH264Video,
+		})
+		tsMuxer.SetPCRPID(hlsMuxerVideoPID)
+	}
+
+	if m.audioTrackID >= 0 {
+		tsMuxer.AddElementaryStream(astits.PMTElementaryStream{
+			ElementaryPID: hlsMuxerAudioPID,
+			StreamType:    astits.StreamTypeAACAudio,
+		})
+		if m.videoTrackID < 0 {
+			tsMuxer.SetPCRPID(hlsMuxerAudioPID)
+		}
+	}
+
+	tsMuxer.WriteTables()
+
+	m.curSegment = &hlsMuxerCurSegment{
+		buf:       buf,
+		tsMuxer:   tsMuxer,
+		startTime: time.Now(),
+	}
+}
+
+func (m *hlsMuxer) writeVideoLocked(nalus [][]byte, pts time.Duration) error {
+	var annexB []byte
+	for _, nalu := range nalus {
+		annexB = append(annexB, 0x00, 0x00, 0x00, 0x01)
+		annexB = append(annexB, nalu...)
+	}
+
+	_, err := m.curSegment.tsMuxer.WriteData(&astits.MuxerData{
+		PID: hlsMuxerVideoPID,
+		PES: &astits.PESData{
+			Header: &astits.PESHeader{
+				StreamID: 0xe0,
+				OptionalHeader: &astits.PESOptionalHeader{
+					MarkerBits:      2,
+					PTSDTSIndicator: astits.PTSDTSIndicatorOnlyPTS,
+					PTS:             ptsToClockRef(pts),
+				},
+			},
+			Data: annexB,
+		},
+	})
+	return err
+}
+
+func (m *hlsMuxer) writeAudioLocked(aus [][]byte, pts time.Duration) error {
+	byts, err := aac.EncodeADTS(m.audioConfig, aus)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.curSegment.tsMuxer.WriteData(&astits.MuxerData{
+		PID: hlsMuxerAudioPID,
+		PES: &astits.PESData{
+			Header: &astits.PESHeader{
+				StreamID: 0xc0,
+				OptionalHeader: &astits.PESOptionalHeader{
+					MarkerBits:      2,
+					PTSDTSIndicator: astits.PTSDTSIndicatorOnlyPTS,
+					PTS:             ptsToClockRef(pts),
+				},
+			},
+			Data: byts,
+		},
+	})
+	return err
+}
+
+// onSegmentFinishedLocked appends a freshly muxed TS segment to the ring,
+// evicting the oldest one once segmentCount is exceeded.
+func (m *hlsMuxer) onSegmentFinishedLocked(buf *bytes.Buffer, duration time.Duration) {
+	seg := &hlsMuxerSegment{
+		name:     fmt.Sprintf("segment%d.ts", m.nextSegmentID),
+		duration: duration,
+		buf:      buf,
+	}
+	m.nextSegmentID++
+
+	m.segments = append(m.segments, seg)
+	if len(m.segments) > m.segmentCount {
+		m.segments = m.segments[len(m.segments)-m.segmentCount:]
+	}
+}
+
+func (m *hlsMuxer) segmentByName(name string) *hlsMuxerSegment {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, seg := range m.segments {
+		if seg.name == name {
+			return seg
+		}
+	}
+
+	return nil
+}
+
+// playlist renders the current media playlist, in the same style used by
+// segmentByName: read-only, computed from the segment ring.
+func (m *hlsMuxer) playlist() []byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	buf.WriteString("#EXT-X-VERSION:3\n")
+	buf.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(m.segmentDuration.Seconds())))
+	buf.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", m.nextSegmentID-len(m.segments)))
+
+	for _, seg := range m.segments {
+		buf.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", seg.duration.Seconds()))
+		buf.WriteString(seg.name + "\n")
+	}
+
+	return buf.Bytes()
+}
+
+// handleRequest serves index.m3u8, stream.m3u8 and segmentN.ts for this
+// muxer's path. name is the request path with the "/{path}/" prefix
+// already stripped by the manager.
+func (m *hlsMuxer) handleRequest(w http.ResponseWriter, name string) {
+	m.mutex.Lock()
+	m.lastRequestTime = time.Now()
+	m.mutex.Unlock()
+
+	switch {
+	case name == "index.m3u8" || name == "stream.m3u8":
+		w.Header().Set("Content-Type", `application/vnd.apple.mpegurl`)
+		w.Write(m.playlist())
+
+	default:
+		seg := m.segmentByName(name)
+		if seg == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "video/MP2T")
+		w.Write(seg.buf.Bytes())
+	}
+}
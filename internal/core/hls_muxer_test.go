@@ -0,0 +1,102 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/rtph264"
+	"github.com/asticode/go-astits"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/h264"
+)
+
+// TestHLSMuxerOnFrameWritesSPSPPS drives a synthetic RTP/H264 access unit
+// through hlsMuxer.onFrame and checks that the resulting TS segment starts
+// with an IDR preceded by SPS and PPS, since TS/Annex-B has no out-of-band
+// channel for parameter sets like the RTP track's SDP has.
+func TestHLSMuxerOnFrameWritesSPSPPS(t *testing.T) {
+	sps := []byte{0x67, 0xAA, 0xBB, 0xCC}
+	pps := []byte{0x68, 0xDD}
+	idr := []byte{0x65, 0x01, 0x02, 0x03, 0x04}
+
+	m := &hlsMuxer{
+		segmentCount:    3,
+		segmentDuration: time.Hour,
+		videoTrackID:    0,
+		audioTrackID:    -1,
+		videoDecoder:    rtph264.NewDecoder(),
+		videoSPS:        sps,
+		videoPPS:        pps,
+	}
+
+	encoder := rtph264.NewEncoder(96, nil, nil, nil)
+	pkts, err := encoder.Encode([][]byte{idr}, 0)
+	require.NoError(t, err)
+
+	for _, pkt := range pkts {
+		byts, err := pkt.Marshal()
+		require.NoError(t, err)
+		m.onFrame(0, gortsplib.StreamTypeRTP, byts)
+	}
+
+	require.NotNil(t, m.curSegment)
+
+	m.mutex.Lock()
+	m.onSegmentFinishedLocked(m.curSegment.buf, time.Second)
+	seg := m.segments[0]
+	m.mutex.Unlock()
+
+	nalus := readVideoNALUsFromTS(t, seg.buf.Bytes())
+	require.Len(t, nalus, 3)
+	require.Equal(t, h264.NALUTypeSPS, h264.NALUType(nalus[0][0]&0x1F))
+	require.Equal(t, h264.NALUTypePPS, h264.NALUType(nalus[1][0]&0x1F))
+	require.Equal(t, h264.NALUTypeIDR, h264.NALUType(nalus[2][0]&0x1F))
+}
+
+// TestHLSMuxerFirstSegmentStartsOnKeyframe checks that a non-IDR access
+// unit arriving before any keyframe doesn't open a segment.
+func TestHLSMuxerFirstSegmentStartsOnKeyframe(t *testing.T) {
+	nonIDR := []byte{0x61, 0x01, 0x02}
+
+	m := &hlsMuxer{
+		segmentCount:    3,
+		segmentDuration: time.Hour,
+		videoTrackID:    0,
+		audioTrackID:    -1,
+		videoDecoder:    rtph264.NewDecoder(),
+	}
+
+	encoder := rtph264.NewEncoder(96, nil, nil, nil)
+	pkts, err := encoder.Encode([][]byte{nonIDR}, 0)
+	require.NoError(t, err)
+
+	for _, pkt := range pkts {
+		byts, err := pkt.Marshal()
+		require.NoError(t, err)
+		m.onFrame(0, gortsplib.StreamTypeRTP, byts)
+	}
+
+	require.Nil(t, m.curSegment)
+}
+
+func readVideoNALUsFromTS(t *testing.T, ts []byte) [][]byte {
+	dem := astits.NewDemuxer(context.Background(), bufio.NewReader(bytes.NewReader(ts)))
+
+	for {
+		data, err := dem.NextData()
+		require.NoError(t, err)
+
+		if data.PES == nil || data.PID != hlsMuxerVideoPID {
+			continue
+		}
+
+		nalus, err := h264.DecodeAnnexB(data.PES.Data)
+		require.NoError(t, err)
+		return nalus
+	}
+}
@@ -2,15 +2,23 @@ package core
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	gopath "path"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/rtpaac"
 	"github.com/aler9/gortsplib/pkg/rtph264"
 	"github.com/asticode/go-astits"
 	"github.com/grafov/m3u8"
@@ -22,10 +30,211 @@ import (
 )
 
 const (
-	hlsSourceRetryPause     = 5 * time.Second
-	hlsSourcePauseWhenEmpty = 5 * time.Second
+	hlsSourceRetryPause             = 5 * time.Second
+	hlsSourcePlaylistRefreshPause   = 5 * time.Second
+	hlsSourceQueueSize              = 100
+	hlsSourceMaxDownloadedURIs      = 100
+	hlsSourceMinSegmentsBeforeStart = 2
 )
 
+// clientSegmentQueue is a bounded FIFO queue of downloaded segment bytes,
+// shared between the downloader goroutine (producer) and the processor
+// goroutine (consumer).
+type clientSegmentQueue struct {
+	mutex   sync.Mutex
+	queue   [][]byte
+	didPush chan struct{}
+	didPull chan struct{}
+}
+
+func newClientSegmentQueue() *clientSegmentQueue {
+	return &clientSegmentQueue{
+		didPush: make(chan struct{}, 1),
+		didPull: make(chan struct{}, 1),
+	}
+}
+
+func (q *clientSegmentQueue) size() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.queue)
+}
+
+// waitUntilSizeIsBelow blocks until the queue has less than n elements,
+// or ctx is canceled.
+func (q *clientSegmentQueue) waitUntilSizeIsBelow(ctx context.Context, n int) error {
+	for {
+		if q.size() < n {
+			return nil
+		}
+
+		select {
+		case <-q.didPull:
+		case <-ctx.Done():
+			return fmt.Errorf("terminated")
+		}
+	}
+}
+
+// waitUntilSizeIsAtLeast blocks until the queue has at least n elements,
+// or ctx is canceled.
+func (q *clientSegmentQueue) waitUntilSizeIsAtLeast(ctx context.Context, n int) error {
+	for {
+		if q.size() >= n {
+			return nil
+		}
+
+		select {
+		case <-q.didPush:
+		case <-ctx.Done():
+			return fmt.Errorf("terminated")
+		}
+	}
+}
+
+func (q *clientSegmentQueue) push(seg []byte) {
+	q.mutex.Lock()
+	q.queue = append(q.queue, seg)
+	q.mutex.Unlock()
+
+	select {
+	case q.didPush <- struct{}{}:
+	default:
+	}
+}
+
+func (q *clientSegmentQueue) pull(ctx context.Context) ([]byte, error) {
+	for {
+		q.mutex.Lock()
+		if len(q.queue) > 0 {
+			seg := q.queue[0]
+			q.queue = q.queue[1:]
+			q.mutex.Unlock()
+
+			select {
+			case q.didPull <- struct{}{}:
+			default:
+			}
+
+			return seg, nil
+		}
+		q.mutex.Unlock()
+
+		select {
+		case <-q.didPush:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("terminated")
+		}
+	}
+}
+
+// hlsSourceURISet is a bounded set used to avoid re-downloading segments
+// that were already fetched, without growing forever on long-running streams.
+type hlsSourceURISet struct {
+	max   int
+	order []string
+	set   map[string]struct{}
+}
+
+func newHLSSourceURISet(max int) *hlsSourceURISet {
+	return &hlsSourceURISet{
+		max: max,
+		set: make(map[string]struct{}),
+	}
+}
+
+func (s *hlsSourceURISet) contains(ur string) bool {
+	_, ok := s.set[ur]
+	return ok
+}
+
+func (s *hlsSourceURISet) add(ur string) {
+	if s.contains(ur) {
+		return
+	}
+
+	s.order = append(s.order, ur)
+	s.set[ur] = struct{}{}
+
+	if len(s.order) > s.max {
+		delete(s.set, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+const (
+	// hlsClockPTSOffset is added to every emitted PTS so that the first one
+	// is positive and DTS never exceeds PTS across a GOP boundary.
+	hlsClockPTSOffset = 2 * time.Second
+
+	// hlsClockPTSMax is 2^33, the modulus of the 90kHz PTS/DTS fields.
+	hlsClockPTSMax = uint64(1) << 33
+)
+
+// hlsClockPeriod is the wall-clock duration of one full PTS cycle.
+var hlsClockPeriod = time.Duration(hlsClockPTSMax) * time.Second / 90000
+
+// hlsClockTrack identifies which of a source's timelines a PTS belongs to.
+// Raw TS PIDs aren't a safe map key here: the video rendition and a
+// separate AUDIO alternative rendition each have their own independent PMT
+// namespace (see segmentProcess vs segmentProcessAudioOnly) and commonly
+// reuse the same PID numbers, so two unrelated timelines could collide
+// under one key.
+type hlsClockTrack int
+
+const (
+	hlsClockTrackVideo hlsClockTrack = iota
+	hlsClockTrackAudio
+)
+
+// hlsClock turns raw, per-track 90kHz PTS values into a single monotonic,
+// positive timeline shared by every track of a source, unwrapping 33-bit
+// wraparounds and anchoring the first sample seen on any track to
+// hlsClockPTSOffset. Sharing one clock across the video and audio tracks
+// keeps them in sync.
+type hlsClock struct {
+	mutex     sync.Mutex
+	anchorSet bool
+	anchor    time.Duration
+	rtc       time.Time
+	lastRaw   map[hlsClockTrack]uint64
+	wrapAdj   map[hlsClockTrack]time.Duration
+}
+
+func newHLSClock() *hlsClock {
+	return &hlsClock{
+		lastRaw: make(map[hlsClockTrack]uint64),
+		wrapAdj: make(map[hlsClockTrack]time.Duration),
+	}
+}
+
+// process converts a raw PTS.Base value seen on track into pts, the value
+// to use as the track's output timestamp, and pace, the same value without
+// hlsClockPTSOffset, meant to be compared against time.Since(rtc) for
+// real-time pacing.
+func (c *hlsClock) process(track hlsClockTrack, rawPTS uint64) (pts time.Duration, pace time.Duration, rtc time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if last, ok := c.lastRaw[track]; ok && (int64(last)-int64(rawPTS)) > int64(hlsClockPTSMax/2) {
+		c.wrapAdj[track] += hlsClockPeriod
+	}
+	c.lastRaw[track] = rawPTS
+
+	unwrapped := time.Duration(float64(rawPTS))*time.Second/90000 + c.wrapAdj[track]
+
+	if !c.anchorSet {
+		c.anchorSet = true
+		c.anchor = unwrapped
+		c.rtc = time.Now()
+	}
+
+	pace = unwrapped - c.anchor
+	pts = pace + hlsClockPTSOffset
+	rtc = c.rtc
+	return
+}
+
 func hlsSourceURLAbsolute(base *url.URL, relative string) (*url.URL, error) {
 	u, err := url.Parse(relative)
 	if err != nil {
@@ -47,19 +256,31 @@ func hlsSourceURLAbsolute(base *url.URL, relative string) (*url.URL, error) {
 type hlsSourceInstance struct {
 	s *hlsSource
 
-	ctx           context.Context
-	ctxCancel     func()
-	ur            *url.URL
-	queue         []string
-	pmtDownloaded bool
-	videoPID      *uint16
-	videoSPS      []byte
-	videoPPS      []byte
-	videoTrack    *gortsplib.Track
-	videoEncoder  *rtph264.Encoder
-	audioPID      *uint16
-	rtcpSenders   *rtcpsenderset.RTCPSenderSet
-	stream        *stream
+	ctx            context.Context
+	ctxCancel      func()
+	ur             *url.URL
+	queue          *clientSegmentQueue
+	downloadedURIs *hlsSourceURISet
+	pmtDownloaded  bool
+
+	// set when the master playlist references a separate AUDIO rendition;
+	// demuxed independently and in parallel with the video rendition
+	audioUR             *url.URL
+	audioQueue          *clientSegmentQueue
+	audioDownloadedURIs *hlsSourceURISet
+	audioPMTDownloaded  bool
+
+	clock        *hlsClock
+	videoPID     *uint16
+	videoSPS     []byte
+	videoPPS     []byte
+	videoTrack   *gortsplib.Track
+	videoEncoder *rtph264.Encoder
+	audioPID     *uint16
+	audioTrack   *gortsplib.Track
+	audioEncoder *rtpaac.Encoder
+	rtcpSenders  *rtcpsenderset.RTCPSenderSet
+	stream       *stream
 }
 
 func newHLSSourceInstance(
@@ -67,9 +288,12 @@ func newHLSSourceInstance(
 	ctx, ctxCancel := context.WithCancel(s.ctx)
 
 	return &hlsSourceInstance{
-		s:         s,
-		ctx:       ctx,
-		ctxCancel: ctxCancel,
+		s:              s,
+		ctx:            ctx,
+		ctxCancel:      ctxCancel,
+		queue:          newClientSegmentQueue(),
+		downloadedURIs: newHLSSourceURISet(hlsSourceMaxDownloadedURIs),
+		clock:          newHLSClock(),
 	}
 }
 
@@ -84,36 +308,71 @@ func (si *hlsSourceInstance) run() error {
 		}
 	}()
 
-	for {
-		if len(si.queue) <= 1 {
-			err := si.queueFill()
-			if err != nil {
-				return err
-			}
-		}
+	// resolve the master playlist and fill the initial queues synchronously,
+	// so we know by the time workers are spawned whether a separate audio
+	// rendition exists. The very first fill is unbounded: the processor
+	// that drains the queue isn't running yet, so waiting for it to drop
+	// below hlsSourceQueueSize here would deadlock on any playlist whose
+	// initial window is larger than that.
+	err := si.downloaderFillQueue(true)
+	if err != nil {
+		return err
+	}
 
-		if len(si.queue) == 0 {
-			si.s.log(logger.Debug, "segment queue is empty, waiting")
+	workers := []func() error{si.downloaderRun, si.processorRun}
 
-			select {
-			case <-time.After(hlsSourcePauseWhenEmpty):
-			case <-si.ctx.Done():
-				return fmt.Errorf("terminated")
-			}
-			continue
+	if si.audioUR != nil {
+		si.audioQueue = newClientSegmentQueue()
+		si.audioDownloadedURIs = newHLSSourceURISet(hlsSourceMaxDownloadedURIs)
+
+		err := si.audioDownloaderFillQueue(true)
+		if err != nil {
+			return err
 		}
 
-		var el string
-		el, si.queue = si.queue[0], si.queue[1:]
+		workers = append(workers, si.audioDownloaderRun, si.audioProcessorRun)
+	}
+
+	errs := make(chan error, len(workers))
+	for _, w := range workers {
+		w := w
+		go func() {
+			errs <- w()
+		}()
+	}
+
+	result := <-errs
+	si.ctxCancel()
+	for i := 1; i < len(workers); i++ {
+		<-errs
+	}
+
+	return result
+}
+
+// downloaderRun periodically refreshes the playlist and pushes newly
+// appeared segments into the queue, overlapping network I/O with demuxing
+// done by the processor.
+func (si *hlsSourceInstance) downloaderRun() error {
+	for {
+		select {
+		case <-time.After(hlsSourcePlaylistRefreshPause):
+		case <-si.ctx.Done():
+			return fmt.Errorf("terminated")
+		}
 
-		err := si.segmentProcess(el)
+		err := si.downloaderFillQueue(false)
 		if err != nil {
 			return err
 		}
 	}
 }
 
-func (si *hlsSourceInstance) queueFill() error {
+// downloaderFillQueue downloads the current playlist and pushes any
+// not-yet-seen segment into the queue. If first is true, pushes are not
+// bounded by hlsSourceQueueSize: this is used for the initial fill, which
+// happens before the processor goroutine that drains the queue exists.
+func (si *hlsSourceInstance) downloaderFillQueue(first bool) error {
 	pl, err := func() (*m3u8.MediaPlaylist, error) {
 		if si.ur == nil {
 			return si.playlistDownloadMaster()
@@ -129,69 +388,123 @@ func (si *hlsSourceInstance) queueFill() error {
 			break
 		}
 
-		if !si.queueContainsURI(seg.URI) {
-			si.queue = append(si.queue, seg.URI)
+		if si.downloadedURIs.contains(seg.URI) {
+			continue
+		}
+		si.downloadedURIs.add(seg.URI)
+
+		if !first {
+			err := si.queue.waitUntilSizeIsBelow(si.ctx, hlsSourceQueueSize)
+			if err != nil {
+				return err
+			}
+		}
+
+		byts, err := si.segmentDownload(seg.URI)
+		if err != nil {
+			return err
 		}
+
+		si.queue.push(byts)
 	}
 
 	return nil
 }
 
-func (si *hlsSourceInstance) queueContainsURI(ur string) bool {
-	for _, q := range si.queue {
-		if q == ur {
-			return true
+// processorRun waits for a minimum amount of buffered segments before
+// starting playback, then pulls segments off the queue and demuxes them.
+func (si *hlsSourceInstance) processorRun() error {
+	err := si.queue.waitUntilSizeIsAtLeast(si.ctx, hlsSourceMinSegmentsBeforeStart)
+	if err != nil {
+		return err
+	}
+
+	for {
+		byts, err := si.queue.pull(si.ctx)
+		if err != nil {
+			return err
+		}
+
+		err = si.segmentProcess(byts)
+		if err != nil {
+			return err
 		}
 	}
-	return false
 }
 
-func (si *hlsSourceInstance) playlistDownloadMaster() (*m3u8.MediaPlaylist, error) {
-	var err error
-	si.ur, err = url.Parse(si.s.ur)
-	if err != nil {
-		return nil, err
+func (si *hlsSourceInstance) segmentDownload(segmentURI string) ([]byte, error) {
+	return si.segmentDownloadFrom(si.ur, segmentURI)
+}
+
+// audioDownloaderRun mirrors downloaderRun for the separate AUDIO
+// alternative rendition, when the master playlist provides one.
+func (si *hlsSourceInstance) audioDownloaderRun() error {
+	for {
+		select {
+		case <-time.After(hlsSourcePlaylistRefreshPause):
+		case <-si.ctx.Done():
+			return fmt.Errorf("terminated")
+		}
+
+		err := si.audioDownloaderFillQueue(false)
+		if err != nil {
+			return err
+		}
 	}
+}
 
-	pl, err := si.playlistDownloadSingle()
+// audioDownloaderFillQueue mirrors downloaderFillQueue for the separate
+// AUDIO alternative rendition.
+func (si *hlsSourceInstance) audioDownloaderFillQueue(first bool) error {
+	pl, err := si.playlistDownloadMediaFrom(si.audioUR)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	switch plt := pl.(type) {
-	case *m3u8.MediaPlaylist:
-		return plt, nil
+	for _, seg := range pl.Segments {
+		if seg == nil {
+			break
+		}
 
-	case *m3u8.MasterPlaylist:
-		// take the variant with the highest bandwidth
-		var chosenVariant *m3u8.Variant
-		for _, v := range plt.Variants {
-			if chosenVariant == nil ||
-				v.VariantParams.Bandwidth > chosenVariant.VariantParams.Bandwidth {
-				chosenVariant = v
-			}
+		if si.audioDownloadedURIs.contains(seg.URI) {
+			continue
 		}
+		si.audioDownloadedURIs.add(seg.URI)
 
-		if chosenVariant == nil {
-			return nil, fmt.Errorf("no variants found")
+		if !first {
+			err := si.audioQueue.waitUntilSizeIsBelow(si.ctx, hlsSourceQueueSize)
+			if err != nil {
+				return err
+			}
 		}
 
-		u, err := hlsSourceURLAbsolute(si.ur, chosenVariant.URI)
+		byts, err := si.segmentDownloadFrom(si.audioUR, seg.URI)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		si.ur = u
+		si.audioQueue.push(byts)
+	}
 
-		return si.playlistDownloadMedia()
+	return nil
+}
 
-	default:
-		return nil, fmt.Errorf("invalid playlist")
+func (si *hlsSourceInstance) audioProcessorRun() error {
+	for {
+		byts, err := si.audioQueue.pull(si.ctx)
+		if err != nil {
+			return err
+		}
+
+		err = si.segmentProcessAudioOnly(byts)
+		if err != nil {
+			return err
+		}
 	}
 }
 
-func (si *hlsSourceInstance) playlistDownloadMedia() (*m3u8.MediaPlaylist, error) {
-	pl, err := si.playlistDownloadSingle()
+func (si *hlsSourceInstance) playlistDownloadMediaFrom(ur *url.URL) (*m3u8.MediaPlaylist, error) {
+	pl, err := si.playlistDownloadSingleFrom(ur)
 	if err != nil {
 		return nil, err
 	}
@@ -204,14 +517,14 @@ func (si *hlsSourceInstance) playlistDownloadMedia() (*m3u8.MediaPlaylist, error
 	return plt, nil
 }
 
-func (si *hlsSourceInstance) playlistDownloadSingle() (m3u8.Playlist, error) {
-	si.s.log(logger.Debug, "downloading playlist %s", si.ur)
-	req, err := http.NewRequestWithContext(si.ctx, "GET", si.ur.String(), nil)
+func (si *hlsSourceInstance) playlistDownloadSingleFrom(ur *url.URL) (m3u8.Playlist, error) {
+	si.s.log(logger.Debug, "downloading playlist %s", ur)
+	req, err := http.NewRequestWithContext(si.ctx, "GET", ur.String(), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := si.s.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -229,29 +542,153 @@ func (si *hlsSourceInstance) playlistDownloadSingle() (m3u8.Playlist, error) {
 	return pl, nil
 }
 
-func (si *hlsSourceInstance) segmentProcess(segmentURI string) error {
-	u, err := hlsSourceURLAbsolute(si.ur, segmentURI)
+func (si *hlsSourceInstance) segmentDownloadFrom(base *url.URL, segmentURI string) ([]byte, error) {
+	u, err := hlsSourceURLAbsolute(base, segmentURI)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	si.s.log(logger.Debug, "downloading segment %s", u)
 	req, err := http.NewRequestWithContext(si.ctx, "GET", u.String(), nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := si.s.httpClient.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status code: %d", res.StatusCode)
+		return nil, fmt.Errorf("bad status code: %d", res.StatusCode)
 	}
 
-	dem := astits.NewDemuxer(context.Background(), bufio.NewReader(res.Body))
+	return ioutil.ReadAll(res.Body)
+}
+
+// hlsSourceSupportedCodecPrefixes lists the RFC 6381 codec prefixes this
+// source is able to decode.
+var hlsSourceSupportedCodecPrefixes = []string{"avc1.", "mp4a."}
+
+// codecParametersAreSupported returns true if every codec listed in a
+// variant's CODECS attribute is one this source can decode. An empty CODECS
+// attribute is treated as unsupported.
+func codecParametersAreSupported(codecs string) bool {
+	if codecs == "" {
+		return false
+	}
+
+	for _, codec := range strings.Split(codecs, ",") {
+		codec = strings.TrimSpace(codec)
+
+		supported := false
+		for _, prefix := range hlsSourceSupportedCodecPrefixes {
+			if strings.HasPrefix(codec, prefix) {
+				supported = true
+				break
+			}
+		}
+
+		if !supported {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (si *hlsSourceInstance) playlistDownloadMaster() (*m3u8.MediaPlaylist, error) {
+	var err error
+	si.ur, err = url.Parse(si.s.ur)
+	if err != nil {
+		return nil, err
+	}
+
+	pl, err := si.playlistDownloadSingle()
+	if err != nil {
+		return nil, err
+	}
+
+	switch plt := pl.(type) {
+	case *m3u8.MediaPlaylist:
+		return plt, nil
+
+	case *m3u8.MasterPlaylist:
+		// take the variant with the highest bandwidth among those whose
+		// codecs this source can decode
+		var chosenVariant *m3u8.Variant
+		for _, v := range plt.Variants {
+			if !codecParametersAreSupported(v.VariantParams.Codecs) {
+				continue
+			}
+
+			if chosenVariant == nil ||
+				v.VariantParams.Bandwidth > chosenVariant.VariantParams.Bandwidth {
+				chosenVariant = v
+			}
+		}
+
+		if chosenVariant == nil {
+			return nil, fmt.Errorf("no variant with supported codecs found")
+		}
+
+		if chosenVariant.VariantParams.Audio != "" {
+			u, err := si.audioAlternativeURL(plt, chosenVariant.VariantParams.Audio)
+			if err != nil {
+				return nil, err
+			}
+			si.audioUR = u
+		}
+
+		u, err := hlsSourceURLAbsolute(si.ur, chosenVariant.URI)
+		if err != nil {
+			return nil, err
+		}
+
+		si.ur = u
+
+		return si.playlistDownloadMedia()
+
+	default:
+		return nil, fmt.Errorf("invalid playlist")
+	}
+}
+
+// audioAlternativeURL looks up the AUDIO alternative renditions of the
+// given group, preferring the one marked as default, and resolves its URI.
+func (si *hlsSourceInstance) audioAlternativeURL(plt *m3u8.MasterPlaylist, groupID string) (*url.URL, error) {
+	var chosen *m3u8.Alternative
+
+	for _, v := range plt.Variants {
+		for _, alt := range v.Alternatives {
+			if alt.GroupId != groupID || alt.URI == "" {
+				continue
+			}
+
+			if chosen == nil || alt.Default {
+				chosen = alt
+			}
+		}
+	}
+
+	if chosen == nil {
+		return nil, fmt.Errorf("audio group '%s' not found", groupID)
+	}
+
+	return hlsSourceURLAbsolute(si.ur, chosen.URI)
+}
+
+func (si *hlsSourceInstance) playlistDownloadMedia() (*m3u8.MediaPlaylist, error) {
+	return si.playlistDownloadMediaFrom(si.ur)
+}
+
+func (si *hlsSourceInstance) playlistDownloadSingle() (m3u8.Playlist, error) {
+	return si.playlistDownloadSingleFrom(si.ur)
+}
+
+func (si *hlsSourceInstance) segmentProcess(segment []byte) error {
+	dem := astits.NewDemuxer(context.Background(), bufio.NewReader(bytes.NewReader(segment)))
 
 	// get PMT
 	if !si.pmtDownloaded {
@@ -273,29 +710,25 @@ func (si *hlsSourceInstance) segmentProcess(segmentURI string) error {
 				switch e.StreamType {
 				case astits.StreamTypeH264Video:
 					if si.videoPID != nil {
-						return fmt.Errorf("multiple video/audio tracks are not supported")
+						return fmt.Errorf("multiple video tracks are not supported")
 					}
 
 					v := e.ElementaryPID
 					si.videoPID = &v
 
-					/*case astits.StreamTypeAACAudio:
+				case astits.StreamTypeAACAudio:
 					if si.audioPID != nil {
-						return fmt.Errorf("multiple video/audio tracks are not supported")
+						return fmt.Errorf("multiple audio tracks are not supported")
 					}
 
 					v := e.ElementaryPID
-					si.audioPID = &v*/
+					si.audioPID = &v
 				}
 			}
 			break
 		}
 	}
 
-	videoInitialized := false
-	var videoStartPTS time.Duration
-	var videoStartRTC time.Time
-
 	for {
 		data, err := dem.NextData()
 		if err != nil {
@@ -320,21 +753,14 @@ func (si *hlsSourceInstance) segmentProcess(segmentURI string) error {
 				return fmt.Errorf("PTS is missing")
 			}
 
-			pts := time.Duration(float64(data.PES.Header.OptionalHeader.PTS.Base)) * time.Second / 90000
-			if !videoInitialized {
-				videoInitialized = true
-				videoStartPTS = pts
-				videoStartRTC = time.Now()
-			}
-
-			fmt.Println(pts)
+			pts, pace, rtc := si.clock.process(hlsClockTrackVideo, data.PES.Header.OptionalHeader.PTS.Base)
 
-			now := time.Since(videoStartRTC)
-			if (pts - videoStartPTS) > now {
+			now := time.Since(rtc)
+			if pace > now {
 				select {
 				case <-si.ctx.Done():
 					return fmt.Errorf("terminated")
-				case <-time.After(pts - videoStartPTS - now):
+				case <-time.After(pace - now):
 				}
 			}
 
@@ -395,51 +821,199 @@ func (si *hlsSourceInstance) segmentProcess(segmentURI string) error {
 				return fmt.Errorf("ERR while encoding H264: %v", err)
 			}
 
-			fmt.Println("TODO", pkts)
-			/*for _, pkt := range pkts {
-				si.onFrame(si.videoTrack.ID, pkt)
-			}*/
+			for _, pkt := range pkts {
+				byts, err := pkt.Marshal()
+				if err != nil {
+					return fmt.Errorf("ERR while marshaling RTP packet: %v", err)
+				}
+
+				si.onFrame(si.videoTrack.ID, byts)
+			}
 
 		} else if si.audioPID != nil && data.PID == *si.audioPID {
-			pkts, err := aac.DecodeADTS(data.PES.Data)
+			err := si.handleAudioPES(data.PES)
 			if err != nil {
 				return err
 			}
+		}
+	}
+}
+
+// handleAudioPES decodes an AAC PES packet, initializing the audio track
+// on the first one, and feeds the resulting AUs to the RTP encoder.
+func (si *hlsSourceInstance) handleAudioPES(pes *astits.PESData) error {
+	if pes.Header.OptionalHeader == nil ||
+		pes.Header.OptionalHeader.PTS == nil {
+		return fmt.Errorf("PTS is missing")
+	}
 
-			fmt.Println("TODO", pkts)
+	pts, pace, rtc := si.clock.process(hlsClockTrackAudio, pes.Header.OptionalHeader.PTS.Base)
+
+	now := time.Since(rtc)
+	if pace > now {
+		select {
+		case <-si.ctx.Done():
+			return fmt.Errorf("terminated")
+		case <-time.After(pace - now):
 		}
 	}
+
+	pkts, err := aac.DecodeADTS(pes.Data)
+	if err != nil {
+		return err
+	}
+
+	if si.audioTrack == nil {
+		err := si.initAudioTrack(pkts[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	if si.audioEncoder == nil {
+		return nil
+	}
+
+	var aus [][]byte
+	for _, pkt := range pkts {
+		aus = append(aus, pkt.AU)
+	}
+
+	rtpPkts, err := si.audioEncoder.Encode(aus, pts)
+	if err != nil {
+		return fmt.Errorf("ERR while encoding AAC: %v", err)
+	}
+
+	for _, pkt := range rtpPkts {
+		byts, err := pkt.Marshal()
+		if err != nil {
+			return fmt.Errorf("ERR while marshaling RTP packet: %v", err)
+		}
+
+		si.onFrame(si.audioTrack.ID, byts)
+	}
+
+	return nil
 }
 
-func (si *hlsSourceInstance) initVideoTrack() error {
-	var tracks gortsplib.Tracks
+// segmentProcessAudioOnly demuxes a TS segment coming from a separate AUDIO
+// alternative rendition, which carries its own PMT and PID space.
+func (si *hlsSourceInstance) segmentProcessAudioOnly(segment []byte) error {
+	dem := astits.NewDemuxer(context.Background(), bufio.NewReader(bytes.NewReader(segment)))
+
+	if !si.audioPMTDownloaded {
+		for {
+			data, err := dem.NextData()
+			if err != nil {
+				if err == astits.ErrNoMorePackets {
+					return nil
+				}
+				return err
+			}
+
+			if data.PMT == nil {
+				continue
+			}
+
+			si.audioPMTDownloaded = true
+			for _, e := range data.PMT.ElementaryStreams {
+				if e.StreamType == astits.StreamTypeAACAudio {
+					if si.audioPID != nil {
+						return fmt.Errorf("multiple audio tracks are not supported")
+					}
+
+					v := e.ElementaryPID
+					si.audioPID = &v
+				}
+			}
+			break
+		}
+	}
 
+	for {
+		data, err := dem.NextData()
+		if err != nil {
+			if err == astits.ErrNoMorePackets {
+				return nil
+			}
+			return err
+		}
+
+		if data.PES == nil || si.audioPID == nil || data.PID != *si.audioPID {
+			continue
+		}
+
+		err = si.handleAudioPES(data.PES)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (si *hlsSourceInstance) initVideoTrack() error {
 	var err error
 	si.videoTrack, err = gortsplib.NewTrackH264(96, si.videoSPS, si.videoPPS)
 	if err != nil {
 		return err
 	}
-	tracks = append(tracks, si.videoTrack)
 	si.videoEncoder = rtph264.NewEncoder(96, nil, nil, nil)
 
+	return si.setupTracksIfReady()
+}
+
+func (si *hlsSourceInstance) initAudioTrack(pkt *aac.ADTSPacket) error {
+	var err error
+	si.audioTrack, err = gortsplib.NewTrackAAC(97, &gortsplib.MPEG4AudioConfig{
+		Type:         gortsplib.MPEG4AudioType(pkt.Type),
+		SampleRate:   pkt.SampleRate,
+		ChannelCount: pkt.ChannelCount,
+	})
+	if err != nil {
+		return err
+	}
+	si.audioEncoder = rtpaac.NewEncoder(97, pkt.SampleRate)
+
+	return si.setupTracksIfReady()
+}
+
+func (si *hlsSourceInstance) setupTracksIfReady() error {
+	if si.stream != nil {
+		return nil
+	}
+
+	if si.videoPID != nil && si.videoTrack == nil {
+		return nil
+	}
+
+	if si.audioPID != nil && si.audioTrack == nil {
+		return nil
+	}
+
+	var tracks gortsplib.Tracks
+	if si.videoTrack != nil {
+		tracks = append(tracks, si.videoTrack)
+	}
+	if si.audioTrack != nil {
+		tracks = append(tracks, si.audioTrack)
+	}
+
 	res := si.s.parent.OnSourceStaticSetReady(pathSourceStaticSetReadyReq{
 		Tracks: tracks,
 	})
 	if res.Err != nil {
-		return err
+		return res.Err
 	}
 
 	si.s.log(logger.Info, "ready")
 
 	si.stream = res.Stream
-	// si.rtcpSenders = rtcpsenderset.New(tracks, res.SP.OnFrame)
+	si.rtcpSenders = rtcpsenderset.New(tracks, si.stream.onFrame)
 
 	return nil
 }
 
 func (si *hlsSourceInstance) onFrame(trackID int, payload []byte) {
-	// si.rtcpSenders.OnFrame(trackID, gortsplib.StreamTypeRTP, payload)
-	// si.sp.OnFrame(trackID, gortsplib.StreamTypeRTP, payload)
+	si.rtcpSenders.OnFrame(trackID, gortsplib.StreamTypeRTP, payload)
 }
 
 type hlsSourceParent interface {
@@ -449,27 +1023,67 @@ type hlsSourceParent interface {
 }
 
 type hlsSource struct {
-	ur     string
-	wg     *sync.WaitGroup
-	parent hlsSourceParent
+	ur                string
+	sourceFingerprint string
+	wg                *sync.WaitGroup
+	parent            hlsSourceParent
+
+	ctx        context.Context
+	ctxCancel  func()
+	httpClient *http.Client
+}
+
+// hlsSourceNewHTTPClient returns an *http.Client with keep-alives enabled
+// that, when fingerprint is non-empty, accepts a TLS connection only if the
+// SHA-256 of the leaf certificate matches it, ignoring the usual chain
+// validation. This allows pulling from self-signed HLS origins, analogous
+// to the RTSP source's fingerprint option.
+func hlsSourceNewHTTPClient(fingerprint string) *http.Client {
+	tlsConfig := &tls.Config{}
+
+	if fingerprint != "" {
+		tlsConfig.InsecureSkipVerify = true
+		fingerprint = strings.ToLower(fingerprint)
+
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("no certificate provided")
+			}
+
+			h := sha256.Sum256(rawCerts[0])
+			hstr := hex.EncodeToString(h[:])
 
-	ctx       context.Context
-	ctxCancel func()
+			if hstr != fingerprint {
+				return fmt.Errorf("server fingerprint mismatch: expected %s, got %s", fingerprint, hstr)
+			}
+
+			return nil
+		}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+		},
+	}
 }
 
 func newHLSSource(
 	parentCtx context.Context,
 	ur string,
+	sourceFingerprint string,
 	wg *sync.WaitGroup,
 	parent hlsSourceParent) *hlsSource {
 	ctx, ctxCancel := context.WithCancel(parentCtx)
 
 	s := &hlsSource{
-		ur:        ur,
-		wg:        wg,
-		parent:    parent,
-		ctx:       ctx,
-		ctxCancel: ctxCancel,
+		ur:                ur,
+		sourceFingerprint: sourceFingerprint,
+		wg:                wg,
+		parent:            parent,
+		ctx:               ctx,
+		ctxCancel:         ctxCancel,
+		httpClient:        hlsSourceNewHTTPClient(sourceFingerprint),
 	}
 
 	s.log(logger.Info, "started")
@@ -0,0 +1,54 @@
+package core
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/grafov/m3u8"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodecParametersAreSupported(t *testing.T) {
+	for _, ca := range []struct {
+		name    string
+		codecs  string
+		support bool
+	}{
+		{"empty", "", false},
+		{"h264 only", "avc1.64001f", true},
+		{"h264+aac", `avc1.64001f,mp4a.40.2`, true},
+		{"spaces", `avc1.64001f, mp4a.40.2`, true},
+		{"hevc", "hvc1.1.6.L93.B0", false},
+		{"opus", "opus", false},
+		{"h264+opus", `avc1.64001f,opus`, false},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			require.Equal(t, ca.support, codecParametersAreSupported(ca.codecs))
+		})
+	}
+}
+
+func TestAudioAlternativeURL(t *testing.T) {
+	base, err := url.Parse("https://example.com/live/master.m3u8")
+	require.NoError(t, err)
+	si := &hlsSourceInstance{ur: base}
+
+	plt := &m3u8.MasterPlaylist{
+		Variants: []*m3u8.Variant{
+			{
+				Alternatives: []*m3u8.Alternative{
+					{GroupId: "aac", URI: "audio-lo.m3u8", Default: false},
+					{GroupId: "aac", URI: "audio-hi.m3u8", Default: true},
+					{GroupId: "other", URI: "other.m3u8", Default: true},
+				},
+			},
+		},
+	}
+
+	u, err := si.audioAlternativeURL(plt, "aac")
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com/live/audio-hi.m3u8", u.String())
+
+	_, err = si.audioAlternativeURL(plt, "missing")
+	require.Error(t, err)
+}